@@ -0,0 +1,103 @@
+// Package cache implements a persistent, content-addressed index of
+// chunks that have already been written into some layer blob in an OCI
+// image directory, so a later octoci build that sees the same chunk
+// again (e.g. an unchanged file in an otherwise-updated rootfs) can
+// skip recompressing it and just point at the earlier copy. This
+// mirrors the blob-info-cache pattern containers/image uses for
+// cross-build blob reuse.
+package cache
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// Entry records where a previously-seen chunk's bytes live: which layer
+// blob, and at what byte range within it.
+type Entry struct {
+	LayerDigest digest.Digest `json:"layerDigest"`
+	Offset      int64         `json:"offset"`
+	Size        int64         `json:"size"`
+}
+
+const indexFileName = "index.json"
+
+// Cache is a persistent sha256(uncompressed chunk content) -> Entry
+// index, backed by a single JSON file under dir.
+type Cache struct {
+	dir     string
+	mu      sync.Mutex
+	entries map[digest.Digest]Entry
+}
+
+// Open loads (or creates) the chunk cache rooted at dir.
+func Open(dir string) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	c := &Cache{dir: dir, entries: map[digest.Digest]Entry{}}
+
+	raw, err := ioutil.ReadFile(filepath.Join(dir, indexFileName))
+	if os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(raw, &c.entries); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Lookup returns the Entry previously recorded for chunkDigest, if any.
+func (c *Cache) Lookup(chunkDigest digest.Digest) (Entry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[chunkDigest]
+	return e, ok
+}
+
+// Put records (or overwrites) where chunkDigest's bytes can be found.
+func (c *Cache) Put(chunkDigest digest.Digest, e Entry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[chunkDigest] = e
+}
+
+// Save persists the cache's index back to dir.
+func (c *Cache) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	raw, err := json.Marshal(c.entries)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(c.dir, indexFileName), raw, 0644)
+}
+
+// GC removes entries whose backing blob no longer exists under ociDir,
+// and returns how many were removed.
+func (c *Cache) GC(ociDir string) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	removed := 0
+	for chunkDigest, e := range c.entries {
+		blobPath := filepath.Join(ociDir, "blobs", e.LayerDigest.Algorithm().String(), e.LayerDigest.Encoded())
+		if _, err := os.Stat(blobPath); os.IsNotExist(err) {
+			delete(c.entries, chunkDigest)
+			removed++
+		} else if err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
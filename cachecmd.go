@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/anuvu/octoci/cache"
+	"github.com/urfave/cli"
+)
+
+var cacheCmd = cli.Command{
+	Name:  "cache",
+	Usage: "manage the --chunk-cache used by build",
+	Subcommands: []cli.Command{
+		cacheGCCmd,
+	},
+}
+
+var cacheGCCmd = cli.Command{
+	Name:   "gc",
+	Usage:  "prune cache entries whose backing blobs no longer exist",
+	Action: doCacheGC,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "chunk-cache",
+			Usage: "the chunk cache dir to gc",
+			Value: "chunk-cache",
+		},
+		cli.StringFlag{
+			Name:  "oci-dir",
+			Usage: "the OCI dir the cache's layer digests should still exist in",
+			Value: "oci",
+		},
+	},
+}
+
+func doCacheGC(ctx *cli.Context) error {
+	c, err := cache.Open(ctx.String("chunk-cache"))
+	if err != nil {
+		return err
+	}
+
+	removed, err := c.GC(ctx.String("oci-dir"))
+	if err != nil {
+		return err
+	}
+
+	if err := c.Save(); err != nil {
+		return err
+	}
+
+	fmt.Printf("removed %d stale cache entries\n", removed)
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// mediaTypeImageLayerZstd is not yet part of the stable OCI image-spec
+// (it's only in ispec as an experimental type in newer releases), so
+// it's spelled out here to support older image-spec versions too.
+const mediaTypeImageLayerZstd = "application/vnd.oci.image.layer.v1.tar+zstd"
+
+// layerCompressor is the common interface addBlob needs from whichever
+// compressor --compression selects: something that wraps an io.Writer,
+// can be asked to flush mid-stream (for the max-layer-size heuristic),
+// and must be closed to finalize the stream.
+type layerCompressor interface {
+	io.Writer
+	Flush() error
+	Close() error
+}
+
+// newLayerCompressor returns the layerCompressor for the given
+// --compression value, writing to w.
+func newLayerCompressor(compression string, w io.Writer) (layerCompressor, error) {
+	switch compression {
+	case "", "gzip":
+		gzw := pgzip.NewWriter(w)
+		gzw.SetConcurrency(250000, 2*runtime.NumCPU())
+		return gzw, nil
+	case "zstd":
+		return zstd.NewWriter(w)
+	default:
+		return nil, fmt.Errorf("unknown compression %q", compression)
+	}
+}
+
+// layerMediaType returns the OCI layer media type for a layer built with
+// the given --compression value.
+func layerMediaType(compression string) string {
+	if compression == "zstd" {
+		return mediaTypeImageLayerZstd
+	}
+	return ispec.MediaTypeImageLayerGzip
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// eStargz: each tar entry is its own gzip stream, plus a TOC appended at
+// the end, so a range-GET client can lazily fetch individual files. See
+// https://github.com/containerd/stargz-snapshotter/blob/main/docs/stargz-estargz.md.
+const (
+	estargzTOCTarName          = "stargz.index.json"
+	estargzPrefetchLandmark    = ".prefetch.landmark"
+	estargzNoPrefetchLandmark  = ".no.prefetch.landmark"
+	estargzChunkSize           = 4 << 20 // split files bigger than this into independent chunks
+	estargzFooterSize          = 47
+	estargzTOCDigestAnnotation = "containerd.io/snapshot/stargz/toc.digest"
+)
+
+type estargzTOCEntry struct {
+	Name        string            `json:"name"`
+	Type        string            `json:"type"`
+	Size        int64             `json:"size,omitempty"`
+	ModTime     string            `json:"modtime,omitempty"`
+	LinkName    string            `json:"linkName,omitempty"`
+	Mode        int64             `json:"mode,omitempty"`
+	UID         int               `json:"uid,omitempty"`
+	GID         int               `json:"gid,omitempty"`
+	Offset      int64             `json:"offset,omitempty"`
+	ChunkOffset int64             `json:"chunkOffset,omitempty"`
+	ChunkSize   int64             `json:"chunkSize,omitempty"`
+	Xattrs      map[string]string `json:"xattrs,omitempty"`
+}
+
+type estargzTOC struct {
+	Version int               `json:"version"`
+	Entries []estargzTOCEntry `json:"entries"`
+}
+
+// orderEstargzEntries puts the prioritized files first, followed by a
+// prefetch landmark, then everything else (or just a no-prefetch
+// landmark, if none were prioritized).
+func orderEstargzEntries(entries []rootfsEntry, prioritized []string) []rootfsEntry {
+	if len(prioritized) == 0 {
+		ordered := make([]rootfsEntry, 0, len(entries)+1)
+		ordered = append(ordered, landmarkEntry(estargzNoPrefetchLandmark))
+		ordered = append(ordered, entries...)
+		return ordered
+	}
+
+	wanted := make(map[string]bool, len(prioritized))
+	for _, p := range prioritized {
+		wanted[p] = true
+	}
+
+	byRel := make(map[string]rootfsEntry, len(entries))
+	var rest []rootfsEntry
+	for _, e := range entries {
+		rel := e.path[len(e.rootfs):]
+		if wanted[rel] {
+			byRel[rel] = e
+		} else {
+			rest = append(rest, e)
+		}
+	}
+
+	ordered := make([]rootfsEntry, 0, len(entries)+1)
+	for _, p := range prioritized {
+		if e, ok := byRel[p]; ok {
+			ordered = append(ordered, e)
+		}
+	}
+	ordered = append(ordered, landmarkEntry(estargzPrefetchLandmark))
+	ordered = append(ordered, rest...)
+	return ordered
+}
+
+// landmarkEntry synthesizes a rootfsEntry for a landmark file, which
+// doesn't exist on disk.
+func landmarkEntry(name string) rootfsEntry {
+	return rootfsEntry{rootfs: "", path: name, info: nil}
+}
+
+func (e rootfsEntry) isLandmark() bool {
+	return e.info == nil
+}
+
+// addBlobEstargz is the estargz equivalent of addBlob.
+func (rp *rootfsProcessor) addBlobEstargz(ctx context.Context) error {
+	entries, err := collectSortedRootfsEntries(rp.rootfses, rp.sourceDateEpoch)
+	if err != nil {
+		return err
+	}
+	entries, err = applyWhiteoutStyle(entries, rp.whiteoutStyle)
+	if err != nil {
+		return err
+	}
+	entries = orderEstargzEntries(entries, rp.prioritizedFiles)
+
+	w := newEstargzWriter(rp.sourceDateEpoch, rp.owner, rp.group)
+
+	flush := func() error {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("thread pool cancelled")
+		default:
+		}
+		diffID, toc, err := w.finish()
+		if err != nil {
+			return err
+		}
+		tocDigest := digest.FromBytes(toc)
+
+		blobDigest, size, err := rp.oci.PutBlob(context.Background(), bytes.NewReader(w.buf.Bytes()))
+		if err != nil {
+			return err
+		}
+
+		rp.layerDesc = append(rp.layerDesc, ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageLayerGzip,
+			Size:      size,
+			Digest:    blobDigest,
+			Annotations: map[string]string{
+				estargzTOCDigestAnnotation: tocDigest.String(),
+			},
+		})
+		rp.diffID = append(rp.diffID, diffID)
+
+		w = newEstargzWriter(rp.sourceDateEpoch, rp.owner, rp.group)
+		return nil
+	}
+
+	for _, entry := range entries {
+		if rp.maxLayerSize > 0 && w.uncompressedSize() > 0 {
+			ratio := w.compressionRatio()
+			if float64(w.compressedSize())+ratio*(1000+estargzEntrySizeHint(entry)) > float64(rp.maxLayerSize)-float64(rp.maxLayerSize)*0.05 {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		}
+
+		if err := w.writeEntry(entry); err != nil {
+			return err
+		}
+	}
+
+	return flush()
+}
+
+func estargzEntrySizeHint(e rootfsEntry) float64 {
+	if e.isLandmark() {
+		return 0
+	}
+	return float64(e.info.Size())
+}
+
+// estargzWriter accumulates one estargz layer.
+type estargzWriter struct {
+	buf          bytes.Buffer
+	diffID       digest.Digester
+	toc          estargzTOC
+	compressed   writeCounter
+	uncompressed writeCounter
+
+	sourceDateEpoch *time.Time
+	owner, group    int
+}
+
+func newEstargzWriter(sourceDateEpoch *time.Time, owner, group int) *estargzWriter {
+	return &estargzWriter{
+		diffID:          digest.SHA256.Digester(),
+		toc:             estargzTOC{Version: 1},
+		sourceDateEpoch: sourceDateEpoch,
+		owner:           owner,
+		group:           group,
+	}
+}
+
+func (w *estargzWriter) uncompressedSize() uint64 { return w.uncompressed.written }
+func (w *estargzWriter) compressedSize() uint64   { return w.compressed.written }
+
+func (w *estargzWriter) compressionRatio() float64 {
+	if w.uncompressed.written == 0 {
+		return 1
+	}
+	return float64(w.compressed.written) / float64(w.uncompressed.written)
+}
+
+// writeEntry tars+gzips one rootfsEntry, splitting files bigger than
+// estargzChunkSize into independent chunks.
+func (w *estargzWriter) writeEntry(e rootfsEntry) error {
+	hdr, err := buildEntryHeader(e)
+	if err != nil {
+		return err
+	}
+
+	if w.sourceDateEpoch != nil {
+		applyReproducibleHeader(hdr, *w.sourceDateEpoch, w.owner, w.group)
+	}
+
+	if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA || hdr.Size == 0 {
+		return w.writeMember(hdr, nil, 0, 0)
+	}
+
+	f, err := os.Open(e.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for offset := int64(0); offset < hdr.Size; offset += estargzChunkSize {
+		size := hdr.Size - offset
+		if size > estargzChunkSize {
+			size = estargzChunkSize
+		}
+		if err := w.writeMember(hdr, io.NewSectionReader(f, offset, size), offset, size); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeMember emits one tar entry as its own gzip member and records it
+// in the TOC. hdr.Size is always the whole file's size; content, when
+// non-nil, is just the [chunkOffset, chunkOffset+chunkSize) slice of it.
+func (w *estargzWriter) writeMember(hdr *tar.Header, content io.Reader, chunkOffset, chunkSize int64) error {
+	memberStart := w.compressed.written
+
+	gzw := gzip.NewWriter(io.MultiWriter(&w.buf, &w.compressed))
+	tw := tar.NewWriter(io.MultiWriter(gzw, &w.uncompressed, w.diffID.Hash()))
+
+	chunkHdr := *hdr
+	if content != nil {
+		chunkHdr.Size = chunkSize
+	}
+	if err := tw.WriteHeader(&chunkHdr); err != nil {
+		return err
+	}
+
+	if content != nil {
+		if _, err := io.Copy(tw, content); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if err := gzw.Close(); err != nil {
+		return err
+	}
+
+	w.toc.Entries = append(w.toc.Entries, estargzTOCEntry{
+		Name:        hdr.Name,
+		Type:        tarTypeName(hdr.Typeflag),
+		Size:        hdr.Size,
+		ModTime:     hdr.ModTime.UTC().Format(estargzTimeFormat),
+		LinkName:    hdr.Linkname,
+		Mode:        hdr.Mode,
+		UID:         hdr.Uid,
+		GID:         hdr.Gid,
+		Offset:      memberStart,
+		ChunkOffset: chunkOffset,
+		ChunkSize:   chunkSize,
+	})
+	return nil
+}
+
+const estargzTimeFormat = "2006-01-02T15:04:05.999999999Z"
+
+func tarTypeName(t byte) string {
+	switch t {
+	case tar.TypeReg, tar.TypeRegA:
+		return "reg"
+	case tar.TypeDir:
+		return "dir"
+	case tar.TypeSymlink:
+		return "symlink"
+	case tar.TypeLink:
+		return "hardlink"
+	case tar.TypeChar:
+		return "char"
+	case tar.TypeBlock:
+		return "block"
+	case tar.TypeFifo:
+		return "fifo"
+	default:
+		return "reg"
+	}
+}
+
+// finish appends the TOC and footer members to w.buf and returns the
+// layer's diffID and raw TOC JSON.
+func (w *estargzWriter) finish() (digest.Digest, []byte, error) {
+	tocJSON, err := json.Marshal(w.toc)
+	if err != nil {
+		return "", nil, err
+	}
+
+	tocOffset := w.compressed.written
+
+	if err := w.writeMember(&tar.Header{
+		Name: estargzTOCTarName,
+		Size: int64(len(tocJSON)),
+		Mode: 0644,
+	}, bytes.NewReader(tocJSON), 0, int64(len(tocJSON))); err != nil {
+		return "", nil, err
+	}
+
+	footer := estargzFooterBytes(int64(tocOffset))
+	w.buf.Write(footer)
+	w.compressed.Write(footer)
+
+	return w.diffID.Digest(), tocJSON, nil
+}
+
+// estargzFooterBytes builds the fixed-size empty gzip member that
+// terminates every estargz blob, encoding the TOC's offset in its Extra
+// header field.
+func estargzFooterBytes(tocOffset int64) []byte {
+	buf := new(bytes.Buffer)
+	gzw, _ := gzip.NewWriterLevel(buf, gzip.NoCompression)
+	gzw.Extra = []byte(fmt.Sprintf("%016xSTARGZ", tocOffset))
+	gzw.Close()
+
+	footer := buf.Bytes()
+	if len(footer) < estargzFooterSize {
+		footer = append(footer, make([]byte, estargzFooterSize-len(footer))...)
+	} else if len(footer) > estargzFooterSize {
+		footer = footer[:estargzFooterSize]
+	}
+	return footer
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// parseEstargzFooter extracts the TOC offset estargzFooterBytes encoded
+// into footer's gzip Extra field.
+func parseEstargzFooter(t *testing.T, footer []byte) int64 {
+	t.Helper()
+	gzr, err := gzip.NewReader(bytes.NewReader(footer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gzr.Extra) != 16+len("STARGZ") {
+		t.Fatalf("len(Extra) = %d, want %d", len(gzr.Extra), 16+len("STARGZ"))
+	}
+	if suffix := string(gzr.Extra[16:]); suffix != "STARGZ" {
+		t.Fatalf("footer suffix = %q, want STARGZ", suffix)
+	}
+	tocOffset, err := strconv.ParseInt(string(gzr.Extra[:16]), 16, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tocOffset
+}
+
+func TestEstargzFooterBytes(t *testing.T) {
+	footer := estargzFooterBytes(12345)
+	if len(footer) != estargzFooterSize {
+		t.Fatalf("len(footer) = %d, want %d", len(footer), estargzFooterSize)
+	}
+	if got := parseEstargzFooter(t, footer); got != 12345 {
+		t.Errorf("tocOffset = %d, want 12345", got)
+	}
+}
+
+func TestEstargzWriterRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "hello.txt")
+	content := []byte("hello estargz")
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := newEstargzWriter(nil, -1, -1)
+	if err := w.writeEntry(rootfsEntry{rootfs: dir, path: path, info: info}); err != nil {
+		t.Fatal(err)
+	}
+	diffID, tocJSON, err := w.finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffID == "" {
+		t.Error("finish() returned empty diffID")
+	}
+
+	blob := w.buf.Bytes()
+	footer := blob[len(blob)-estargzFooterSize:]
+	tocOffset := parseEstargzFooter(t, footer)
+
+	// The gzip member at tocOffset must be the TOC we got back from finish().
+	tocGzr, err := gzip.NewReader(bytes.NewReader(blob[tocOffset:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(tocGzr)
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Name != estargzTOCTarName {
+		t.Errorf("toc tar entry name = %q, want %q", hdr.Name, estargzTOCTarName)
+	}
+	gotTOC, err := io.ReadAll(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(gotTOC, tocJSON) {
+		t.Errorf("toc bytes from blob = %q, want %q", gotTOC, tocJSON)
+	}
+
+	var toc estargzTOC
+	if err := json.Unmarshal(gotTOC, &toc); err != nil {
+		t.Fatal(err)
+	}
+	if len(toc.Entries) != 1 {
+		t.Fatalf("got %d TOC entries, want 1", len(toc.Entries))
+	}
+	if toc.Entries[0].Name != "/hello.txt" {
+		t.Errorf("entry name = %q, want %q", toc.Entries[0].Name, "/hello.txt")
+	}
+}
@@ -7,13 +7,13 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 
+	"github.com/anuvu/octoci/cache"
 	"github.com/anuvu/octoci/pool"
-	"github.com/klauspost/pgzip"
 	"github.com/openSUSE/umoci"
 	"github.com/openSUSE/umoci/oci/casext"
 	"github.com/opencontainers/go-digest"
@@ -31,7 +31,7 @@ func main() {
 	app.Name = "octoci"
 	app.Usage = "octoci octopus merges rootfses into an OCI image"
 	app.Version = version
-	app.Commands = []cli.Command{buildCmd}
+	app.Commands = []cli.Command{buildCmd, cacheCmd}
 
 	if err := app.Run(os.Args); err != nil {
 		fmt.Fprintf(os.Stderr, "error: %+v", err)
@@ -44,6 +44,30 @@ var buildCmd = cli.Command{
 	Usage:  "builds an octoci image",
 	Action: doBuild,
 	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "base-image",
+			Usage: "a containers/image transport:reference for the base image, e.g. docker://docker.io/library/alpine:latest",
+		},
+		cli.StringFlag{
+			Name:  "dest",
+			Usage: "a containers/image transport:reference to push the finished image to, e.g. docker://registry.example.com/foo:latest",
+		},
+		cli.StringFlag{
+			Name:  "src-creds",
+			Usage: "username[:password] for --base-image, if it needs auth",
+		},
+		cli.StringFlag{
+			Name:  "dest-creds",
+			Usage: "username[:password] for --dest, if it needs auth",
+		},
+		cli.BoolFlag{
+			Name:  "src-tls-verify",
+			Usage: "require TLS verification when pulling --base-image (previously always skipped)",
+		},
+		cli.BoolTFlag{
+			Name:  "dest-tls-verify",
+			Usage: "require TLS verification when pushing to --dest",
+		},
 		cli.StringFlag{
 			Name:  "oci-dir",
 			Usage: "the output OCI dir to use",
@@ -68,10 +92,45 @@ var buildCmd = cli.Command{
 			Name:  "max-layer-size",
 			Usage: "don't build layers bigger than size N (bytes)",
 		},
+		cli.StringFlag{
+			Name:  "format",
+			Usage: "layer format to produce: gzip or estargz",
+			Value: "gzip",
+		},
+		cli.StringFlag{
+			Name:  "compression",
+			Usage: "layer compression to use: gzip, zstd or zstd-chunked",
+			Value: "gzip",
+		},
+		cli.StringFlag{
+			Name:  "estargz-prioritized-files",
+			Usage: "path to a \\n separated list of files (relative to a rootfs) to place first in estargz layers, for lazy-pull prefetching",
+		},
+		cli.StringFlag{
+			Name:  "chunk-cache",
+			Usage: "dir to keep a persistent content-addressed chunk cache in, for deduplicating across builds",
+		},
+		cli.StringFlag{
+			Name:  "source-date-epoch",
+			Usage: "unix timestamp to clamp all layer file times and the image config's created fields to, for reproducible builds (falls back to $SOURCE_DATE_EPOCH)",
+		},
+		cli.IntFlag{
+			Name:  "owner",
+			Usage: "uid to force every layer entry to, for reproducible builds",
+			Value: -1,
+		},
+		cli.IntFlag{
+			Name:  "group",
+			Usage: "gid to force every layer entry to, for reproducible builds",
+			Value: -1,
+		},
+		cli.StringFlag{
+			Name:  "whiteout-style",
+			Usage: "whiteout convention used by the rootfses' source directories: overlayfs, aufs or none",
+			Value: "none",
+		},
 	},
-	ArgsUsage: `[base-image] [rootfses]
-
-[base-image] is a skopeo compatible URL for the base image.
+	ArgsUsage: `[rootfses]
 
 [rootfses] is a \n separated list of directories to octomerge.`,
 }
@@ -79,12 +138,16 @@ var buildCmd = cli.Command{
 var otherFailure = fmt.Errorf("got other failure")
 
 func doBuild(ctx *cli.Context) error {
-	if len(ctx.Args()) != 2 {
+	if len(ctx.Args()) != 1 {
 		return fmt.Errorf("wrong number of arguments")
 	}
 
-	baseImage := ctx.Args()[0]
-	rootfsesFile := ctx.Args()[1]
+	baseImage := ctx.String("base-image")
+	if baseImage == "" {
+		return fmt.Errorf("--base-image is required")
+	}
+
+	rootfsesFile := ctx.Args()[0]
 
 	rootfsesFileRaw, err := ioutil.ReadFile(rootfsesFile)
 	if err != nil {
@@ -93,16 +156,66 @@ func doBuild(ctx *cli.Context) error {
 
 	rootfses := strings.Split(strings.TrimSpace(string(rootfsesFileRaw)), "\n")
 
-	output, err := exec.Command(
-		"skopeo",
-		"--insecure-policy",
-		"copy",
-		"--src-tls-verify=false",
+	format := ctx.String("format")
+	if format != "gzip" && format != "estargz" {
+		return errors.Errorf("unknown --format %q", format)
+	}
+
+	compression := ctx.String("compression")
+	switch compression {
+	case "gzip", "zstd", "zstd-chunked":
+	default:
+		return errors.Errorf("unknown --compression %q", compression)
+	}
+	if format == "estargz" && compression != "gzip" {
+		return errors.Errorf("--format=estargz only supports --compression=gzip")
+	}
+
+	sourceDateEpoch, err := parseSourceDateEpoch(ctx.String("source-date-epoch"))
+	if err != nil {
+		return err
+	}
+
+	whiteoutStyle := ctx.String("whiteout-style")
+	switch whiteoutStyle {
+	case "", "none", "aufs", "overlayfs":
+	default:
+		return errors.Errorf("unknown --whiteout-style %q", whiteoutStyle)
+	}
+
+	var chunkCache *cache.Cache
+	if dir := ctx.String("chunk-cache"); dir != "" {
+		if compression != "zstd-chunked" {
+			return errors.Errorf("--chunk-cache requires --compression=zstd-chunked")
+		}
+		chunkCache, err = cache.Open(dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	var prioritizedFiles []string
+	if p := ctx.String("estargz-prioritized-files"); p != "" {
+		if format != "estargz" {
+			return errors.Errorf("--estargz-prioritized-files requires --format=estargz")
+		}
+		raw, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		prioritizedFiles = strings.Split(strings.TrimSpace(string(raw)), "\n")
+	}
+
+	srcCtx, dstCtx := registrySystemContexts(ctx)
+
+	if err := copyImage(
+		context.Background(),
 		baseImage,
 		fmt.Sprintf("oci:%s:%s", ctx.String("oci-dir"), ctx.String("tag")),
-	).CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("image import failed: %s: %s", err, string(output))
+		srcCtx,
+		nil,
+	); err != nil {
+		return fmt.Errorf("image import failed: %v", err)
 	}
 
 	oci, err := umoci.OpenLayout(ctx.String("oci-dir"))
@@ -126,9 +239,18 @@ func doBuild(ctx *cli.Context) error {
 	for i, rootfs := range rootfses {
 		if i%ctx.Int("dirs-per-blob") == 0 {
 			tasks = append(tasks, rootfsProcessor{
-				oci:          oci,
-				rootfses:     []string{},
-				maxLayerSize: ctx.Uint64("max-layer-size"),
+				oci:              oci,
+				ociDir:           ctx.String("oci-dir"),
+				rootfses:         []string{},
+				maxLayerSize:     ctx.Uint64("max-layer-size"),
+				format:           format,
+				compression:      compression,
+				prioritizedFiles: prioritizedFiles,
+				chunkCache:       chunkCache,
+				sourceDateEpoch:  sourceDateEpoch,
+				owner:            ctx.Int("owner"),
+				group:            ctx.Int("group"),
+				whiteoutStyle:    whiteoutStyle,
 			})
 		}
 		rootfs, err = filepath.Abs(rootfs)
@@ -150,6 +272,12 @@ func doBuild(ctx *cli.Context) error {
 		return err
 	}
 
+	if chunkCache != nil {
+		if err := chunkCache.Save(); err != nil {
+			return err
+		}
+	}
+
 	descriptorPaths, err := oci.ResolveReference(context.Background(), ctx.String("tag"))
 	if err != nil {
 		return err
@@ -184,6 +312,11 @@ func doBuild(ctx *cli.Context) error {
 		manifest.Layers = append(manifest.Layers, task.layerDesc...)
 	}
 
+	if sourceDateEpoch != nil {
+		config.Created = sourceDateEpoch
+		config.History = append(config.History, reproducibleHistory(tasks, *sourceDateEpoch)...)
+	}
+
 	digest, size, err := oci.PutBlobJSON(context.Background(), config)
 	if err != nil {
 		return err
@@ -209,6 +342,18 @@ func doBuild(ctx *cli.Context) error {
 		return err
 	}
 
+	if dest := ctx.String("dest"); dest != "" {
+		if err := copyImage(
+			context.Background(),
+			fmt.Sprintf("oci:%s:%s", ctx.String("oci-dir"), ctx.String("tag")),
+			dest,
+			nil,
+			dstCtx,
+		); err != nil {
+			return fmt.Errorf("pushing to %s failed: %v", dest, err)
+		}
+	}
+
 	return nil
 }
 
@@ -223,14 +368,92 @@ func (wc *writeCounter) Write(p []byte) (n int, err error) {
 }
 
 type rootfsProcessor struct {
-	oci          casext.Engine
-	maxLayerSize uint64
-	rootfses     []string
-	diffID       []digest.Digest
-	layerDesc    []ispec.Descriptor
+	oci              casext.Engine
+	ociDir           string
+	maxLayerSize     uint64
+	rootfses         []string
+	format           string
+	compression      string
+	prioritizedFiles []string
+	chunkCache       *cache.Cache
+	sourceDateEpoch  *time.Time
+	owner, group     int
+	whiteoutStyle    string
+	diffID           []digest.Digest
+	layerDesc        []ispec.Descriptor
+}
+
+// rootfsEntry is one filesystem entry found under a rootfs. whiteoutHeader,
+// when set, overrides info and is emitted verbatim with no content (an
+// OCI whiteout from applyWhiteoutStyle).
+type rootfsEntry struct {
+	rootfs         string
+	path           string
+	info           os.FileInfo
+	whiteoutHeader *tar.Header
+}
+
+// buildEntryHeader computes the tar.Header for a rootfsEntry.
+func buildEntryHeader(e rootfsEntry) (*tar.Header, error) {
+	if e.whiteoutHeader != nil {
+		return e.whiteoutHeader, nil
+	}
+	if e.info == nil {
+		return &tar.Header{Name: e.path, Typeflag: tar.TypeReg, Mode: 0644}, nil
+	}
+
+	var link string
+	if e.info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		link, err = os.Readlink(e.path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	hdr, err := tar.FileInfoHeader(e.info, link)
+	if err != nil {
+		return nil, err
+	}
+	hdr.Name = e.path[len(e.rootfs):]
+	return hdr, nil
+}
+
+// collectRootfsEntries walks every rootfs and returns their entries in
+// filepath.Walk order, for formats that need the whole list up front.
+func collectRootfsEntries(rootfses []string) ([]rootfsEntry, error) {
+	var entries []rootfsEntry
+	for _, rootfs := range rootfses {
+		rootfs := rootfs
+		err := filepath.Walk(rootfs, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			/* don't import an empty path */
+			if path == rootfs {
+				return nil
+			}
+
+			entries = append(entries, rootfsEntry{rootfs: rootfs, path: path, info: info})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
 }
 
 func (rp *rootfsProcessor) addBlob(ctx context.Context) error {
+	if rp.format == "estargz" {
+		return rp.addBlobEstargz(ctx)
+	}
+
+	if rp.compression == "zstd-chunked" {
+		return rp.addBlobZstdChunked(ctx)
+	}
+
 	ch := make(chan struct {
 		Reader io.ReadCloser
 		DiffID digest.Digester
@@ -242,8 +465,16 @@ func (rp *rootfsProcessor) addBlob(ctx context.Context) error {
 		compressedCounter := &writeCounter{}
 		bothCompressed := io.MultiWriter(compressedCounter, writer)
 
-		gzw := pgzip.NewWriter(bothCompressed)
-		gzw.SetConcurrency(250000, 2*runtime.NumCPU())
+		gzw, err := newLayerCompressor(rp.compression, bothCompressed)
+		if err != nil {
+			ch <- struct {
+				Reader io.ReadCloser
+				DiffID digest.Digester
+			}{reader, digest.SHA256.Digester()}
+			writer.CloseWithError(err)
+			close(ch)
+			return
+		}
 		defer gzw.Close()
 
 		diffID := digest.SHA256.Digester()
@@ -264,33 +495,20 @@ func (rp *rootfsProcessor) addBlob(ctx context.Context) error {
 		defer tw.Close()
 
 		for _, rootfs := range rp.rootfses {
-			handler := func(path string, info os.FileInfo, err error) error {
+			handler := func(e rootfsEntry) error {
 				select {
 				case <-ctx.Done():
 					return pool.ThreadPoolCancelled
 				default:
 				}
 
+				hdr, err := buildEntryHeader(e)
 				if err != nil {
 					return err
 				}
 
-				/* don't import an empty path */
-				if path == rootfs {
-					return nil
-				}
-
-				var link string
-				if info.Mode()&os.ModeSymlink != 0 {
-					link, err = os.Readlink(path)
-					if err != nil {
-						return err
-					}
-				}
-
-				hdr, err := tar.FileInfoHeader(info, link)
-				if err != nil {
-					return err
+				if rp.sourceDateEpoch != nil {
+					applyReproducibleHeader(hdr, *rp.sourceDateEpoch, rp.owner, rp.group)
 				}
 
 				if rp.maxLayerSize > 0 && uncompressedCounter.written > 0 {
@@ -307,8 +525,12 @@ func (rp *rootfsProcessor) addBlob(ctx context.Context) error {
 					if err := gzw.Flush(); err != nil {
 						return err
 					}
+					size := float64(0)
+					if e.info != nil {
+						size = float64(e.info.Size())
+					}
 					ratio := float64(compressedCounter.written) / float64(uncompressedCounter.written)
-					if float64(compressedCounter.written)+ratio*(1000+float64(info.Size())) > float64(rp.maxLayerSize)-float64(rp.maxLayerSize)*0.05 {
+					if float64(compressedCounter.written)+ratio*(1000+size) > float64(rp.maxLayerSize)-float64(rp.maxLayerSize)*0.05 {
 
 						tw.Close()
 						gzw.Close()
@@ -319,8 +541,10 @@ func (rp *rootfsProcessor) addBlob(ctx context.Context) error {
 
 						bothCompressed = io.MultiWriter(compressedCounter, writer)
 
-						gzw = pgzip.NewWriter(bothCompressed)
-						gzw.SetConcurrency(250000, 2*runtime.NumCPU())
+						gzw, err = newLayerCompressor(rp.compression, bothCompressed)
+						if err != nil {
+							return err
+						}
 
 						diffID = digest.SHA256.Digester()
 						tw = tar.NewWriter(io.MultiWriter(uncompressedCounter, gzw, diffID.Hash()))
@@ -334,14 +558,13 @@ func (rp *rootfsProcessor) addBlob(ctx context.Context) error {
 					}
 				}
 
-				hdr.Name = path[len(rootfs):]
 				err = tw.WriteHeader(hdr)
 				if err != nil {
 					return err
 				}
 
-				if hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA {
-					f, err := os.Open(path)
+				if e.whiteoutHeader == nil && e.info != nil && (hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA) {
+					f, err := os.Open(e.path)
 					if err != nil {
 						return err
 					}
@@ -353,7 +576,7 @@ func (rp *rootfsProcessor) addBlob(ctx context.Context) error {
 					}
 
 					if n != hdr.Size {
-						return fmt.Errorf("Huh? bad size for %s", path)
+						return fmt.Errorf("Huh? bad size for %s", e.path)
 					}
 				}
 
@@ -361,7 +584,47 @@ func (rp *rootfsProcessor) addBlob(ctx context.Context) error {
 			}
 
 			fmt.Println("importing rootfs", rootfs)
-			err := filepath.Walk(rootfs, handler)
+			if rp.sourceDateEpoch != nil || rp.whiteoutStyle == "overlayfs" {
+				// Don't rely on filepath.Walk's directory-iteration
+				// order for reproducibility, and give
+				// applyWhiteoutStyle a chance to insert synthetic
+				// whiteout/opaque entries: both need the whole
+				// entry list up front rather than a stream.
+				entries, err := collectRootfsEntries([]string{rootfs})
+				if err != nil {
+					writer.CloseWithError(err)
+					continue
+				}
+				if rp.sourceDateEpoch != nil {
+					sortRootfsEntries(entries)
+				}
+				entries, err = applyWhiteoutStyle(entries, rp.whiteoutStyle)
+				if err != nil {
+					writer.CloseWithError(err)
+					continue
+				}
+
+				for _, e := range entries {
+					if err := handler(e); err != nil {
+						writer.CloseWithError(err)
+						break
+					}
+				}
+				continue
+			}
+
+			err := filepath.Walk(rootfs, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+
+				/* don't import an empty path */
+				if path == rootfs {
+					return nil
+				}
+
+				return handler(rootfsEntry{rootfs: rootfs, path: path, info: info})
+			})
 			if err != nil {
 				writer.CloseWithError(err)
 			}
@@ -388,7 +651,7 @@ func (rp *rootfsProcessor) addBlob(ctx context.Context) error {
 		}
 
 		rp.layerDesc = append(rp.layerDesc, ispec.Descriptor{
-			MediaType: ispec.MediaTypeImageLayerGzip,
+			MediaType: layerMediaType(rp.compression),
 			Size:      size,
 			Digest:    digest,
 		})
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/signature"
+	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/containers/image/v5/types"
+	"github.com/urfave/cli"
+)
+
+// insecurePolicyContext is equivalent to skopeo's --insecure-policy: it
+// accepts every image unconditionally, rather than consulting
+// /etc/containers/policy.json. octoci has never needed signature
+// verification of its inputs, so it never looks for a real policy file.
+func insecurePolicyContext() (*signature.PolicyContext, error) {
+	policy := &signature.Policy{Default: signature.PolicyRequirements{signature.NewPRInsecureAcceptAnything()}}
+	return signature.NewPolicyContext(policy)
+}
+
+// splitCreds splits a "user:pass" --*-creds value the way skopeo does.
+func splitCreds(s string) (string, string) {
+	if s == "" {
+		return "", ""
+	}
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+func systemContext(creds string, tlsVerify bool) *types.SystemContext {
+	sc := &types.SystemContext{
+		DockerInsecureSkipTLSVerify: types.NewOptionalBool(!tlsVerify),
+	}
+	if user, pass := splitCreds(creds); user != "" {
+		sc.DockerAuthConfig = &types.DockerAuthConfig{Username: user, Password: pass}
+	}
+	return sc
+}
+
+// copyImage copies src to dst using containers/image/v5, in place of
+// shelling out to skopeo. srcCtx/dstCtx carry credentials and TLS
+// settings for the source/destination transports respectively.
+func copyImage(ctx context.Context, src, dst string, srcCtx, dstCtx *types.SystemContext) error {
+	srcRef, err := alltransports.ParseImageName(src)
+	if err != nil {
+		return fmt.Errorf("parsing source image %q: %v", src, err)
+	}
+
+	dstRef, err := alltransports.ParseImageName(dst)
+	if err != nil {
+		return fmt.Errorf("parsing destination image %q: %v", dst, err)
+	}
+
+	policyCtx, err := insecurePolicyContext()
+	if err != nil {
+		return err
+	}
+	defer policyCtx.Destroy()
+
+	_, err = copy.Image(ctx, policyCtx, dstRef, srcRef, &copy.Options{
+		SourceCtx:      srcCtx,
+		DestinationCtx: dstCtx,
+	})
+	return err
+}
+
+// registrySystemContexts builds the source and destination
+// types.SystemContext from build's --src-creds/--dest-creds/
+// --src-tls-verify/--dest-tls-verify flags.
+func registrySystemContexts(ctx *cli.Context) (src, dst *types.SystemContext) {
+	src = systemContext(ctx.String("src-creds"), ctx.Bool("src-tls-verify"))
+	dst = systemContext(ctx.String("dest-creds"), ctx.Bool("dest-tls-verify"))
+	return src, dst
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// parseSourceDateEpoch parses --source-date-epoch, falling back to
+// SOURCE_DATE_EPOCH (https://reproducible-builds.org/specs/source-date-epoch/).
+// A nil result means reproducible-build mode is off.
+func parseSourceDateEpoch(flagValue string) (*time.Time, error) {
+	raw := flagValue
+	if raw == "" {
+		raw = os.Getenv("SOURCE_DATE_EPOCH")
+	}
+	if raw == "" {
+		return nil, nil
+	}
+
+	sec, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --source-date-epoch/SOURCE_DATE_EPOCH %q: %v", raw, err)
+	}
+	t := time.Unix(sec, 0).UTC()
+	return &t, nil
+}
+
+// applyReproducibleHeader clamps hdr's timestamps to epoch and strips
+// its ownership. owner/group of -1 leaves the filesystem's uid/gid alone.
+func applyReproducibleHeader(hdr *tar.Header, epoch time.Time, owner, group int) {
+	hdr.ModTime = epoch
+	hdr.AccessTime = epoch
+	hdr.ChangeTime = epoch
+	hdr.Uname = ""
+	hdr.Gname = ""
+	if owner >= 0 {
+		hdr.Uid = owner
+	}
+	if group >= 0 {
+		hdr.Gid = group
+	}
+}
+
+// sortRootfsEntries sorts entries in place by the tar header name they
+// will get.
+func sortRootfsEntries(entries []rootfsEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].path[len(entries[i].rootfs):] < entries[j].path[len(entries[j].rootfs):]
+	})
+}
+
+// collectSortedRootfsEntries is collectRootfsEntries, but sorts each
+// rootfs's own entries before concatenating rather than sorting the
+// merged result: a later rootfs overriding (or whiteouting) an earlier
+// one's path relies on tar's last-entry-wins semantics, which needs each
+// rootfs's block to stay contiguous and in rootfs order. Sorting only
+// happens when sourceDateEpoch is set; otherwise each rootfs's entries
+// keep filepath.Walk order.
+func collectSortedRootfsEntries(rootfses []string, sourceDateEpoch *time.Time) ([]rootfsEntry, error) {
+	var all []rootfsEntry
+	for _, rootfs := range rootfses {
+		entries, err := collectRootfsEntries([]string{rootfs})
+		if err != nil {
+			return nil, err
+		}
+		if sourceDateEpoch != nil {
+			sortRootfsEntries(entries)
+		}
+		all = append(all, entries...)
+	}
+	return all, nil
+}
+
+// reproducibleHistory builds one ispec.History entry per rootfsProcessor
+// task, stamped with epoch instead of the wall-clock build time.
+func reproducibleHistory(tasks []rootfsProcessor, epoch time.Time) []ispec.History {
+	history := make([]ispec.History, 0, len(tasks))
+	for _, task := range tasks {
+		e := epoch
+		history = append(history, ispec.History{
+			Created:   &e,
+			CreatedBy: fmt.Sprintf("octoci merge %s", strings.Join(task.rootfses, ", ")),
+		})
+	}
+	return history
+}
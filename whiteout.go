@@ -0,0 +1,87 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// The OCI image-layer spec represents a deleted lower-layer path as an
+// empty regular file named ".wh.<name>" next to where it used to live,
+// and a directory that should hide all lower-layer content (rather than
+// just specific deleted entries) as one containing an empty regular
+// file named ".wh..wh..opq". See
+// https://github.com/opencontainers/image-spec/blob/main/layer.md#whiteouts.
+const (
+	ociWhiteoutPrefix  = ".wh."
+	ociOpaqueMarker    = ".wh..wh..opq"
+	overlayOpaqueXattr = "trusted.overlay.opaque"
+)
+
+// applyWhiteoutStyle rewrites entries, translating whatever whiteout
+// convention the rootfses' source directories use (per --whiteout-style)
+// into the OCI's, so a later rootfs in the octomerge can actually delete
+// or opaque-out content an earlier one contributed.
+//
+// aufs names its markers the same way the OCI spec does, so an aufs
+// rootfs needs no translation; "" and "none" pass entries through
+// untouched, leaving any whiteout-looking files to be tarred up as
+// themselves.
+func applyWhiteoutStyle(entries []rootfsEntry, style string) ([]rootfsEntry, error) {
+	switch style {
+	case "", "none", "aufs":
+		return entries, nil
+	case "overlayfs":
+	default:
+		return nil, fmt.Errorf("unknown --whiteout-style %q", style)
+	}
+
+	out := make([]rootfsEntry, 0, len(entries))
+	for _, e := range entries {
+		if isOverlayWhiteoutDevice(e.info) {
+			rel := e.path[len(e.rootfs):]
+			whName := filepath.Join(filepath.Dir(rel), ociWhiteoutPrefix+filepath.Base(rel))
+			out = append(out, rootfsEntry{
+				whiteoutHeader: &tar.Header{Name: whName, Typeflag: tar.TypeReg, Mode: 0644},
+			})
+			continue
+		}
+
+		out = append(out, e)
+
+		if e.info != nil && e.info.IsDir() && hasOverlayOpaqueXattr(e.path) {
+			rel := e.path[len(e.rootfs):]
+			out = append(out, rootfsEntry{
+				whiteoutHeader: &tar.Header{Name: filepath.Join(rel, ociOpaqueMarker), Typeflag: tar.TypeReg, Mode: 0644},
+			})
+		}
+	}
+	return out, nil
+}
+
+// isOverlayWhiteoutDevice reports whether info is an overlayfs-style
+// whiteout marker: a character device with both major and minor number 0.
+func isOverlayWhiteoutDevice(info os.FileInfo) bool {
+	if info == nil || info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	sys, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+	return unix.Major(uint64(sys.Rdev)) == 0 && unix.Minor(uint64(sys.Rdev)) == 0
+}
+
+// hasOverlayOpaqueXattr reports whether path is marked as an opaque
+// directory the overlayfs way: the "trusted.overlay.opaque" xattr set to
+// "y". Not being privileged enough to read a trusted.* xattr is treated
+// the same as the xattr being absent, rather than as an error.
+func hasOverlayOpaqueXattr(path string) bool {
+	buf := make([]byte, 1)
+	n, err := unix.Lgetxattr(path, overlayOpaqueXattr, buf)
+	return err == nil && n == 1 && buf[0] == 'y'
+}
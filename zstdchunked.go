@@ -0,0 +1,409 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/anuvu/octoci/cache"
+	"github.com/klauspost/compress/zstd"
+	digest "github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// zstd:chunked: a normal zstd-compressed tar stream, but each file (or
+// chunk) is its own zstd frame, followed by a JSON manifest and a
+// trailing skippable frame pointing at it, so a partial-pull client can
+// range-GET and dedupe individual chunks. Mirrors containers/storage's
+// zstd:chunked format.
+const (
+	zstdChunkedChunkSize              = 1 << 20 // 1MiB
+	zstdChunkedManifestPositionAnno   = "io.github.containers.zstd-chunked.manifest-position"
+	zstdChunkedManifestChecksumAnno   = "io.github.containers.zstd-chunked.manifest-checksum"
+	zstdChunkedSkippableFrameMagic    = 0x184D2A50
+	zstdChunkedSkippableFrameMagicEnd = 0x184D2A5F
+)
+
+type zstdChunkedManifestEntry struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Size        int64  `json:"size,omitempty"`
+	Mode        int64  `json:"mode,omitempty"`
+	UID         int    `json:"uid,omitempty"`
+	GID         int    `json:"gid,omitempty"`
+	Digest      string `json:"digest,omitempty"`
+	Offset      int64  `json:"offset"`
+	EndOffset   int64  `json:"endOffset"`
+	ChunkSize   int64  `json:"chunkSize,omitempty"`
+	ChunkDigest string `json:"chunkDigest,omitempty"`
+}
+
+type zstdChunkedManifest struct {
+	Entries []zstdChunkedManifestEntry `json:"entries"`
+}
+
+// addBlobZstdChunked is the zstd-chunked equivalent of addBlob.
+func (rp *rootfsProcessor) addBlobZstdChunked(ctx context.Context) error {
+	entries, err := collectSortedRootfsEntries(rp.rootfses, rp.sourceDateEpoch)
+	if err != nil {
+		return err
+	}
+	entries, err = applyWhiteoutStyle(entries, rp.whiteoutStyle)
+	if err != nil {
+		return err
+	}
+
+	w := newZstdChunkedWriter(rp.ociDir, rp.chunkCache, rp.sourceDateEpoch, rp.owner, rp.group)
+
+	flush := func() error {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("thread pool cancelled")
+		default:
+		}
+
+		diffID, manifestPos, manifestChecksum, err := w.finish()
+		if err != nil {
+			return err
+		}
+
+		blobDigest, size, err := rp.oci.PutBlob(context.Background(), bytes.NewReader(w.buf.Bytes()))
+		if err != nil {
+			return err
+		}
+
+		if rp.chunkCache != nil {
+			for _, p := range w.pending {
+				rp.chunkCache.Put(p.chunkDigest, cache.Entry{
+					LayerDigest: blobDigest,
+					Offset:      p.offset,
+					Size:        p.size,
+				})
+			}
+		}
+
+		rp.layerDesc = append(rp.layerDesc, ispec.Descriptor{
+			MediaType: mediaTypeImageLayerZstd,
+			Size:      size,
+			Digest:    blobDigest,
+			Annotations: map[string]string{
+				zstdChunkedManifestPositionAnno: manifestPos,
+				zstdChunkedManifestChecksumAnno: manifestChecksum.String(),
+			},
+		})
+		rp.diffID = append(rp.diffID, diffID)
+
+		w = newZstdChunkedWriter(rp.ociDir, rp.chunkCache, rp.sourceDateEpoch, rp.owner, rp.group)
+		return nil
+	}
+
+	for _, entry := range entries {
+		if rp.maxLayerSize > 0 && w.uncompressed.written > 0 {
+			ratio := w.compressionRatio()
+			size := float64(0)
+			if entry.info != nil {
+				size = float64(entry.info.Size())
+			}
+			if float64(w.compressed.written)+ratio*(1000+size) > float64(rp.maxLayerSize)-float64(rp.maxLayerSize)*0.05 {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		}
+
+		if err := w.writeEntry(entry); err != nil {
+			return err
+		}
+	}
+
+	return flush()
+}
+
+// zstdChunkedWriter accumulates one zstd:chunked layer.
+type zstdChunkedWriter struct {
+	buf          bytes.Buffer
+	diffID       digest.Digester
+	manifest     zstdChunkedManifest
+	compressed   writeCounter
+	uncompressed writeCounter
+
+	// ociDir is the OCI image layout chunkCache's cached layer digests
+	// live in, so a cache hit's bytes can be read straight off disk.
+	ociDir     string
+	chunkCache *cache.Cache
+	// pending records every chunk written into this layer (cache misses
+	// and cache hits alike) that should be added to chunkCache once this
+	// layer's blob digest is known, after PutBlob.
+	pending []pendingCacheEntry
+
+	sourceDateEpoch *time.Time
+	owner, group    int
+}
+
+type pendingCacheEntry struct {
+	chunkDigest  digest.Digest
+	offset, size int64
+}
+
+func newZstdChunkedWriter(ociDir string, chunkCache *cache.Cache, sourceDateEpoch *time.Time, owner, group int) *zstdChunkedWriter {
+	return &zstdChunkedWriter{
+		diffID:          digest.SHA256.Digester(),
+		ociDir:          ociDir,
+		chunkCache:      chunkCache,
+		sourceDateEpoch: sourceDateEpoch,
+		owner:           owner,
+		group:           group,
+	}
+}
+
+func (w *zstdChunkedWriter) compressionRatio() float64 {
+	if w.uncompressed.written == 0 {
+		return 1
+	}
+	return float64(w.compressed.written) / float64(w.uncompressed.written)
+}
+
+func (w *zstdChunkedWriter) writeEntry(e rootfsEntry) error {
+	hdr, err := buildEntryHeader(e)
+	if err != nil {
+		return err
+	}
+
+	if w.sourceDateEpoch != nil {
+		applyReproducibleHeader(hdr, *w.sourceDateEpoch, w.owner, w.group)
+	}
+
+	if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA || hdr.Size == 0 {
+		return w.writeFrame(hdr, nil, 0)
+	}
+
+	f, err := os.Open(e.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for offset := int64(0); offset < hdr.Size; offset += zstdChunkedChunkSize {
+		size := hdr.Size - offset
+		if size > zstdChunkedChunkSize {
+			size = zstdChunkedChunkSize
+		}
+
+		chunk := make([]byte, size)
+		if _, err := io.ReadFull(io.NewSectionReader(f, offset, size), chunk); err != nil {
+			return err
+		}
+
+		if w.chunkCache != nil {
+			chunkDigest := digest.FromBytes(chunk)
+			if cached, ok := w.chunkCache.Lookup(chunkDigest); ok {
+				frame, ok, err := readCachedFrame(w.ociDir, cached)
+				if err != nil {
+					return err
+				}
+				if ok {
+					if err := w.writeReference(hdr, chunk, chunkDigest, frame); err != nil {
+						return err
+					}
+					continue
+				}
+				// The blob the cache pointed at is gone (e.g. GC'd
+				// since it was recorded); fall through and recompress
+				// the chunk like any other cache miss.
+			}
+		}
+
+		if err := w.writeFrame(hdr, chunk, size); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeFrame emits one tar entry (or file chunk) as its own zstd frame
+// and records it in the manifest. When w.chunkCache is set, it's also
+// recorded as pending, to be cached once this layer's digest is known.
+func (w *zstdChunkedWriter) writeFrame(hdr *tar.Header, content []byte, chunkSize int64) error {
+	offset := w.compressed.written
+
+	zw, err := zstd.NewWriter(io.MultiWriter(&w.buf, &w.compressed))
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(io.MultiWriter(zw, &w.uncompressed, w.diffID.Hash()))
+
+	chunkHdr := *hdr
+	if content != nil {
+		chunkHdr.Size = chunkSize
+	}
+	if err := tw.WriteHeader(&chunkHdr); err != nil {
+		return err
+	}
+
+	var chunkDigest digest.Digest
+	if content != nil {
+		if _, err := tw.Write(content); err != nil {
+			return err
+		}
+		chunkDigest = digest.FromBytes(content)
+	}
+
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	entry := zstdChunkedManifestEntry{
+		Name:      hdr.Name,
+		Type:      tarTypeName(hdr.Typeflag),
+		Size:      hdr.Size,
+		Mode:      hdr.Mode,
+		UID:       hdr.Uid,
+		GID:       hdr.Gid,
+		Offset:    offset,
+		EndOffset: w.compressed.written,
+	}
+	if content != nil {
+		entry.ChunkSize = chunkSize
+		entry.ChunkDigest = chunkDigest.String()
+		entry.Digest = entry.ChunkDigest
+
+		if w.chunkCache != nil {
+			w.pending = append(w.pending, pendingCacheEntry{
+				chunkDigest: chunkDigest,
+				offset:      offset,
+				size:        w.compressed.written - offset,
+			})
+		}
+	}
+	w.manifest.Entries = append(w.manifest.Entries, entry)
+	return nil
+}
+
+// readCachedFrame reads a cache hit's compressed zstd frame off the disk
+// of the OCI image layout at ociDir. ok is false (with a nil error) if
+// that blob no longer exists, e.g. it was GC'd since being cached.
+func readCachedFrame(ociDir string, e cache.Entry) ([]byte, bool, error) {
+	blobPath := filepath.Join(ociDir, "blobs", e.LayerDigest.Algorithm().String(), e.LayerDigest.Encoded())
+	f, err := os.Open(blobPath)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+
+	frame := make([]byte, e.Size)
+	if _, err := io.ReadFull(io.NewSectionReader(f, e.Offset, e.Size), frame); err != nil {
+		return nil, false, err
+	}
+	return frame, true, nil
+}
+
+// writeReference copies a previously-cached chunk's compressed frame
+// (read by readCachedFrame) verbatim into this blob instead of
+// recompressing content, while still hashing the tar record into this
+// layer's diffID/uncompressed stream as writeFrame would.
+func (w *zstdChunkedWriter) writeReference(hdr *tar.Header, content []byte, chunkDigest digest.Digest, frame []byte) error {
+	offset := w.compressed.written
+	w.buf.Write(frame)
+	w.compressed.Write(frame)
+
+	tw := tar.NewWriter(io.MultiWriter(&w.uncompressed, w.diffID.Hash()))
+	chunkHdr := *hdr
+	chunkHdr.Size = int64(len(content))
+	if err := tw.WriteHeader(&chunkHdr); err != nil {
+		return err
+	}
+	if _, err := tw.Write(content); err != nil {
+		return err
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	w.manifest.Entries = append(w.manifest.Entries, zstdChunkedManifestEntry{
+		Name:        hdr.Name,
+		Type:        tarTypeName(hdr.Typeflag),
+		Size:        hdr.Size,
+		Mode:        hdr.Mode,
+		UID:         hdr.Uid,
+		GID:         hdr.Gid,
+		Offset:      offset,
+		EndOffset:   w.compressed.written,
+		ChunkSize:   int64(len(content)),
+		ChunkDigest: chunkDigest.String(),
+		Digest:      chunkDigest.String(),
+	})
+
+	if w.chunkCache != nil {
+		w.pending = append(w.pending, pendingCacheEntry{
+			chunkDigest: chunkDigest,
+			offset:      offset,
+			size:        w.compressed.written - offset,
+		})
+	}
+	return nil
+}
+
+// finish appends the manifest frame and the trailing skippable frame to
+// w.buf, and returns the layer's diffID, the manifest's position
+// annotation value ("offset:length"), and its digest.
+func (w *zstdChunkedWriter) finish() (digest.Digest, string, digest.Digest, error) {
+	manifestJSON, err := json.Marshal(w.manifest)
+	if err != nil {
+		return "", "", "", err
+	}
+	manifestChecksum := digest.FromBytes(manifestJSON)
+
+	manifestOffset := w.compressed.written
+
+	zw, err := zstd.NewWriter(io.MultiWriter(&w.buf, &w.compressed))
+	if err != nil {
+		return "", "", "", err
+	}
+	if _, err := zw.Write(manifestJSON); err != nil {
+		return "", "", "", err
+	}
+	if err := zw.Close(); err != nil {
+		return "", "", "", err
+	}
+
+	manifestLength := w.compressed.written - manifestOffset
+	position := fmt.Sprintf("%d:%d", manifestOffset, manifestLength)
+
+	skippable := zstdChunkedSkippableFrame(manifestOffset, manifestLength, manifestChecksum)
+	w.buf.Write(skippable)
+	w.compressed.Write(skippable)
+
+	return w.diffID.Digest(), position, manifestChecksum, nil
+}
+
+// zstdChunkedSkippableFrame builds the trailing zstd skippable frame
+// (magic 0x184D2A5x), whose payload is the manifest's offset and length
+// within the blob followed by its length-prefixed digest string.
+func zstdChunkedSkippableFrame(manifestOffset, manifestLength uint64, manifestChecksum digest.Digest) []byte {
+	checksum := []byte(manifestChecksum.String())
+
+	payload := make([]byte, 16+4+len(checksum))
+	binary.LittleEndian.PutUint64(payload[0:8], manifestOffset)
+	binary.LittleEndian.PutUint64(payload[8:16], manifestLength)
+	binary.LittleEndian.PutUint32(payload[16:20], uint32(len(checksum)))
+	copy(payload[20:], checksum)
+
+	frame := make([]byte, 8, 8+len(payload))
+	binary.LittleEndian.PutUint32(frame[0:4], zstdChunkedSkippableFrameMagic)
+	binary.LittleEndian.PutUint32(frame[4:8], uint32(len(payload)))
+	frame = append(frame, payload...)
+	return frame
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	digest "github.com/opencontainers/go-digest"
+)
+
+func TestZstdChunkedSkippableFrame(t *testing.T) {
+	checksum := digest.FromBytes([]byte(`{"entries":[]}`))
+	frame := zstdChunkedSkippableFrame(100, 42, checksum)
+
+	if magic := binary.LittleEndian.Uint32(frame[0:4]); magic != zstdChunkedSkippableFrameMagic {
+		t.Fatalf("magic = %#x, want %#x", magic, zstdChunkedSkippableFrameMagic)
+	}
+	frameSize := binary.LittleEndian.Uint32(frame[4:8])
+	if int(frameSize) != len(frame)-8 {
+		t.Fatalf("frame size field = %d, want %d", frameSize, len(frame)-8)
+	}
+
+	payload := frame[8:]
+	if offset := binary.LittleEndian.Uint64(payload[0:8]); offset != 100 {
+		t.Errorf("offset = %d, want 100", offset)
+	}
+	if length := binary.LittleEndian.Uint64(payload[8:16]); length != 42 {
+		t.Errorf("length = %d, want 42", length)
+	}
+	checksumLen := binary.LittleEndian.Uint32(payload[16:20])
+	got := digest.Digest(payload[20 : 20+checksumLen])
+	if got != checksum {
+		t.Errorf("checksum = %q, want %q", got, checksum)
+	}
+}
+
+func TestZstdChunkedWriterRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "hello.txt")
+	content := []byte("hello zstd:chunked")
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := newZstdChunkedWriter(dir, nil, nil, -1, -1)
+	if err := w.writeEntry(rootfsEntry{rootfs: dir, path: path, info: info}); err != nil {
+		t.Fatal(err)
+	}
+	diffID, position, manifestChecksum, err := w.finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blob := w.buf.Bytes()
+
+	// The manifest frame is immediately followed by the skippable frame,
+	// which runs to the end of the blob.
+	parts := strings.SplitN(position, ":", 2)
+	if len(parts) != 2 {
+		t.Fatalf("position = %q, want \"offset:length\"", position)
+	}
+	manifestOffset, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestLength, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	skippable := blob[manifestOffset+manifestLength:]
+	if magic := binary.LittleEndian.Uint32(skippable[0:4]); magic != zstdChunkedSkippableFrameMagic {
+		t.Fatalf("trailing frame magic = %#x, want %#x", magic, zstdChunkedSkippableFrameMagic)
+	}
+	frameSize := binary.LittleEndian.Uint32(skippable[4:8])
+	if int(frameSize) != len(skippable)-8 {
+		t.Fatalf("trailing frame isn't the last thing in the blob: size = %d, want %d", frameSize, len(skippable)-8)
+	}
+	payload := skippable[8:]
+	if offset := binary.LittleEndian.Uint64(payload[0:8]); offset != uint64(manifestOffset) {
+		t.Errorf("skippable frame offset = %d, want %d", offset, manifestOffset)
+	}
+	if length := binary.LittleEndian.Uint64(payload[8:16]); length != uint64(manifestLength) {
+		t.Errorf("skippable frame length = %d, want %d", length, manifestLength)
+	}
+	checksumLen := binary.LittleEndian.Uint32(payload[16:20])
+	gotChecksum := digest.Digest(payload[20 : 20+checksumLen])
+	if gotChecksum != manifestChecksum {
+		t.Errorf("skippable frame checksum = %q, want %q", gotChecksum, manifestChecksum)
+	}
+
+	// Decompress the manifest frame at its claimed offset and verify it
+	// both parses and hashes to the checksum the skippable frame points at.
+	zr, err := zstd.NewReader(bytes.NewReader(blob[manifestOffset : manifestOffset+manifestLength]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestJSON, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := digest.FromBytes(manifestJSON); got != manifestChecksum {
+		t.Errorf("manifest digest = %q, want %q", got, manifestChecksum)
+	}
+
+	var manifest zstdChunkedManifest
+	if err := json.Unmarshal(manifestJSON, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Entries) != 1 {
+		t.Fatalf("got %d manifest entries, want 1", len(manifest.Entries))
+	}
+	entry := manifest.Entries[0]
+	if entry.Name != "hello.txt" {
+		t.Errorf("entry.Name = %q, want %q", entry.Name, "hello.txt")
+	}
+
+	// The entry's own frame, decompressed, must be a tar record for the
+	// same content we wrote.
+	zr2, err := zstd.NewReader(bytes.NewReader(blob[entry.Offset:entry.EndOffset]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(zr2)
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Name != "/hello.txt" {
+		t.Errorf("tar entry name = %q, want %q", hdr.Name, "/hello.txt")
+	}
+	got, err := io.ReadAll(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("tar entry content = %q, want %q", got, content)
+	}
+
+	if diffID == "" {
+		t.Error("finish() returned empty diffID")
+	}
+}